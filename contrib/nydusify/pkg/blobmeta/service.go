@@ -0,0 +1,203 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package blobmeta tracks, per nydus blob digest, the set of registry
+// repositories where that blob is already known to exist. Callers that push
+// the same blob to many repositories (the common case when converting a
+// shared base image for several targets) can consult this to attempt a
+// cheap cross-repository blob mount instead of a full re-upload.
+package blobmeta
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxReposPerDigest bounds how many repositories are remembered for a
+// single blob digest. The oldest entry is evicted once the bound is
+// exceeded (LRU by record/refresh order).
+const maxReposPerDigest = 50
+
+const metaFileName = "blobmeta.json"
+
+// Service maps nydus blob digests to the registry repositories where they
+// are known to already exist, persisted as a single JSON file on disk.
+type Service struct {
+	mu   sync.Mutex
+	path string
+	// repos maps digest -> repositories, ordered oldest to newest.
+	repos map[string][]string
+}
+
+// NewService opens (or creates) a blob metadata store rooted at `dir`.
+func NewService(dir string) (*Service, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create blobmeta directory")
+	}
+
+	svc := &Service{
+		path:  filepath.Join(dir, metaFileName),
+		repos: make(map[string][]string),
+	}
+
+	data, err := ioutil.ReadFile(svc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return svc, nil
+		}
+		return nil, errors.Wrap(err, "read blobmeta file")
+	}
+	if err := json.Unmarshal(data, &svc.repos); err != nil {
+		return nil, errors.Wrap(err, "parse blobmeta file")
+	}
+
+	return svc, nil
+}
+
+// MountCandidates returns the repositories where `digest` is known to
+// already exist, most recently confirmed last. The caller should try
+// mounting from these before falling back to a full upload.
+func (svc *Service) MountCandidates(digest string) []string {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	repos := svc.repos[digest]
+	candidates := make([]string, len(repos))
+	copy(candidates, repos)
+	return candidates
+}
+
+// Record registers that `digest` was successfully pushed to (or mounted
+// into) `repo`. Call this only after the registry confirms the blob exists
+// there (e.g. a 201 Created response), so the store never hands out a
+// mount candidate that isn't actually present.
+func (svc *Service) Record(digest, repo string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	repos := svc.repos[digest]
+	for i, r := range repos {
+		if r == repo {
+			// Already known: move to the back as most-recently-confirmed.
+			repos = append(append(repos[:i], repos[i+1:]...), repo)
+			svc.repos[digest] = repos
+			return svc.save()
+		}
+	}
+
+	repos = append(repos, repo)
+	if len(repos) > maxReposPerDigest {
+		repos = repos[len(repos)-maxReposPerDigest:]
+	}
+	svc.repos[digest] = repos
+
+	return svc.save()
+}
+
+// Prune removes `repo` from the candidate list for `digest`. Call this when
+// the registry returns 404 on a mount attempt, meaning our record of that
+// repository was stale.
+func (svc *Service) Prune(digest, repo string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	repos := svc.repos[digest]
+	for i, r := range repos {
+		if r == repo {
+			repos = append(repos[:i], repos[i+1:]...)
+			break
+		}
+	}
+
+	if len(repos) == 0 {
+		delete(svc.repos, digest)
+	} else {
+		svc.repos[digest] = repos
+	}
+
+	return svc.save()
+}
+
+// Mounter abstracts the registry calls Service.Push needs, so this package
+// doesn't depend on a particular registry client.
+type Mounter interface {
+	// Mount attempts to mount `digest` into `repo` from `fromRepo` as a
+	// cross-repository blob mount. ok is false when the registry didn't
+	// have the blob under `fromRepo` (e.g. a 404 on the mount attempt),
+	// which is not itself an error: the caller should try the next
+	// candidate, or fall back to Upload once candidates are exhausted.
+	Mount(ctx context.Context, repo, fromRepo, digest string) (ok bool, err error)
+
+	// Upload pushes the blob into `repo` in full, with no mount possible.
+	Upload(ctx context.Context, repo, digest string) error
+}
+
+// Push ensures `digest` exists in `repo`, trying a cross-repository mount
+// from each known candidate repository before falling back to a full
+// upload. A successful mount or upload records `repo` as a candidate for
+// future Push calls on the same digest; a candidate the registry rejects
+// the mount from is pruned so it isn't retried.
+func (svc *Service) Push(ctx context.Context, mounter Mounter, repo, digest string) error {
+	for _, candidate := range svc.MountCandidates(digest) {
+		if candidate == repo {
+			continue
+		}
+
+		ok, err := mounter.Mount(ctx, repo, candidate, digest)
+		if err != nil {
+			return errors.Wrapf(err, "mount %s from %s into %s", digest, candidate, repo)
+		}
+		if ok {
+			return svc.Record(digest, repo)
+		}
+		if err := svc.Prune(digest, candidate); err != nil {
+			return errors.Wrapf(err, "prune stale mount candidate %s for %s", candidate, digest)
+		}
+	}
+
+	if err := mounter.Upload(ctx, repo, digest); err != nil {
+		return errors.Wrapf(err, "upload %s to %s", digest, repo)
+	}
+
+	return svc.Record(digest, repo)
+}
+
+// save atomically persists the store to disk: write to a temp file in the
+// same directory, fsync, then rename over the real path.
+func (svc *Service) save() error {
+	data, err := json.Marshal(svc.repos)
+	if err != nil {
+		return errors.Wrap(err, "marshal blobmeta")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(svc.path), metaFileName+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "create blobmeta temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write blobmeta temp file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "fsync blobmeta temp file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close blobmeta temp file")
+	}
+
+	if err := os.Rename(tmp.Name(), svc.path); err != nil {
+		return errors.Wrap(err, "rename blobmeta temp file")
+	}
+
+	return nil
+}
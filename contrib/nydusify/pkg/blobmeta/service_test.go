@@ -0,0 +1,94 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package blobmeta
+
+import (
+	"context"
+	"testing"
+)
+
+// fakeMounter records every Mount/Upload call it receives and answers Mount
+// according to `mountable`, keyed by "fromRepo/digest".
+type fakeMounter struct {
+	mountable map[string]bool
+	mounts    []string
+	uploads   []string
+}
+
+func (f *fakeMounter) Mount(_ context.Context, repo, fromRepo, digest string) (bool, error) {
+	f.mounts = append(f.mounts, fromRepo+"->"+repo)
+	return f.mountable[fromRepo+"/"+digest], nil
+}
+
+func (f *fakeMounter) Upload(_ context.Context, repo, digest string) error {
+	f.uploads = append(f.uploads, repo+"/"+digest)
+	return nil
+}
+
+func TestServicePushMountsFromKnownCandidate(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	if err := svc.Record("sha256:abc", "repo-a"); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	mounter := &fakeMounter{mountable: map[string]bool{"repo-a/sha256:abc": true}}
+	if err := svc.Push(context.Background(), mounter, "repo-b", "sha256:abc"); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	if len(mounter.uploads) != 0 {
+		t.Fatalf("Push mounted candidate but still uploaded: %v", mounter.uploads)
+	}
+	candidates := svc.MountCandidates("sha256:abc")
+	if len(candidates) != 2 || candidates[0] != "repo-a" || candidates[1] != "repo-b" {
+		t.Fatalf("MountCandidates after Push = %v, want [repo-a repo-b]", candidates)
+	}
+}
+
+func TestServicePushPrunesRejectedCandidateAndFallsBackToUpload(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	if err := svc.Record("sha256:abc", "repo-a"); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	mounter := &fakeMounter{mountable: map[string]bool{}}
+	if err := svc.Push(context.Background(), mounter, "repo-b", "sha256:abc"); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	if len(mounter.uploads) != 1 || mounter.uploads[0] != "repo-b/sha256:abc" {
+		t.Fatalf("uploads = %v, want a single upload to repo-b", mounter.uploads)
+	}
+
+	candidates := svc.MountCandidates("sha256:abc")
+	if len(candidates) != 1 || candidates[0] != "repo-b" {
+		t.Fatalf("MountCandidates after Push = %v, want rejected repo-a pruned, repo-b recorded", candidates)
+	}
+}
+
+func TestServicePushUploadsWithNoCandidates(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	mounter := &fakeMounter{}
+	if err := svc.Push(context.Background(), mounter, "repo-a", "sha256:abc"); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	if len(mounter.mounts) != 0 {
+		t.Fatalf("Push attempted a mount with no known candidates: %v", mounter.mounts)
+	}
+	if len(mounter.uploads) != 1 {
+		t.Fatalf("uploads = %v, want a single upload", mounter.uploads)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// BlobCache short-circuits `nydus-image` invocations for layer content that
+// has already been converted before, identified by the upstream OCI layer
+// digest together with every builder setting that affects the output.
+// Entries are plain directories on disk so hits can be restored with a
+// hardlink instead of a copy when possible.
+type BlobCache struct {
+	dir string
+
+	CacheHits   int64
+	CacheMisses int64
+}
+
+// blobCacheMeta is the small bit of bookkeeping stored alongside a cached
+// bootstrap fragment and blob, needed to restore a Workflow.buildLayer
+// result without re-running the builder.
+type blobCacheMeta struct {
+	BlobDigest     string
+	BuilderVersion string
+}
+
+// NewBlobCache opens (or creates) a blob cache rooted at `dir`.
+func NewBlobCache(dir string) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create blob cache directory")
+	}
+	return &BlobCache{dir: dir}, nil
+}
+
+// key computes the cache key for a layer build. Two builds with the same
+// key are guaranteed to produce the same bootstrap fragment and blob.
+//
+// `parentIdentity` must capture which parent bootstrap (if any) the build
+// was chained onto: nydus-image's bootstrap output depends on the parent,
+// not just the layer's own content, so builds against different parents
+// (or no parent at all) must never share an entry. Pass "" only when the
+// build truly has no parent.
+func (c *BlobCache) key(layerDigest, chunkDict, imageVersion, prefetchPatterns, whiteoutSpec, parentIdentity string, alignedChunk bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%t",
+		layerDigest, chunkDict, imageVersion, prefetchPatterns, whiteoutSpec, parentIdentity, alignedChunk)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *BlobCache) entryDir(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// Lookup returns the cached bootstrap fragment and blob paths for `key`, if
+// an entry exists. It never mutates the cache or copies anything: the
+// caller decides how to place the returned paths.
+func (c *BlobCache) Lookup(key string) (bootstrapPath, blobPath string, meta blobCacheMeta, ok bool, err error) {
+	dir := c.entryDir(key)
+
+	metaBytes, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			atomic.AddInt64(&c.CacheMisses, 1)
+			return "", "", blobCacheMeta{}, false, nil
+		}
+		return "", "", blobCacheMeta{}, false, err
+	}
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return "", "", blobCacheMeta{}, false, err
+	}
+
+	atomic.AddInt64(&c.CacheHits, 1)
+	return filepath.Join(dir, "bootstrap"), filepath.Join(dir, "blob"), meta, true, nil
+}
+
+// Store populates the cache entry for `key` from a just-completed build.
+// The entry is assembled in a temp directory and renamed into place so a
+// concurrent reader never observes a partially written entry.
+func (c *BlobCache) Store(key, bootstrapPath, blobPath string, meta blobCacheMeta) error {
+	tmpDir, err := ioutil.TempDir(c.dir, key+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "create blob cache temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := linkOrCopy(bootstrapPath, filepath.Join(tmpDir, "bootstrap")); err != nil {
+		return errors.Wrap(err, "cache bootstrap fragment")
+	}
+	if blobPath != "" {
+		if err := linkOrCopy(blobPath, filepath.Join(tmpDir, "blob")); err != nil {
+			return errors.Wrap(err, "cache blob")
+		}
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "marshal blob cache metadata")
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "meta.json"), metaBytes, 0644); err != nil {
+		return errors.Wrap(err, "write blob cache metadata")
+	}
+
+	entryDir := c.entryDir(key)
+	if err := os.RemoveAll(entryDir); err != nil {
+		return errors.Wrap(err, "clear stale blob cache entry")
+	}
+	if err := os.Rename(tmpDir, entryDir); err != nil {
+		return errors.Wrap(err, "rename blob cache entry into place")
+	}
+
+	return nil
+}
+
+// linkOrCopy hardlinks `src` to `dst`, falling back to a copy when the two
+// paths don't share a filesystem.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// Prune deletes the least-recently-modified blob cache entries under `dir`
+// until its total size is at or below `maxSize` bytes, and returns the number
+// of bytes reclaimed. It is the blob cache's garbage-collection entry point;
+// no command-line command calls it.
+func Prune(dir string, maxSize int64) (int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "read blob cache directory")
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime int64
+	}
+
+	var all []entry
+	var total int64
+	for _, info := range entries {
+		if !info.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		size, err := dirSize(path)
+		if err != nil {
+			return 0, errors.Wrapf(err, "size blob cache entry %s", info.Name())
+		}
+		all = append(all, entry{path: path, size: size, modTime: info.ModTime().UnixNano()})
+		total += size
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime < all[j].modTime })
+
+	var reclaimed int64
+	for _, e := range all {
+		if total <= maxSize {
+			break
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			return reclaimed, errors.Wrapf(err, "remove blob cache entry %s", e.path)
+		}
+		total -= e.size
+		reclaimed += e.size
+	}
+
+	return reclaimed, nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
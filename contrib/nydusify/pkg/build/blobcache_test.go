@@ -0,0 +1,121 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlobCacheLookupRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+
+	bootstrap := filepath.Join(dir, "bootstrap")
+	if err := ioutil.WriteFile(bootstrap, []byte("bootstrap-content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(dir, "blob")
+	if err := ioutil.WriteFile(blob, []byte("blob-content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	key := cache.key("layer-digest", "", "", "", "", "parent-a", false)
+
+	if _, _, _, ok, err := cache.Lookup(key); err != nil {
+		t.Fatalf("Lookup before Store: %v", err)
+	} else if ok {
+		t.Fatalf("Lookup before Store: got hit, want miss")
+	}
+
+	meta := blobCacheMeta{BlobDigest: "sha256:deadbeef", BuilderVersion: "v1"}
+	if err := cache.Store(key, bootstrap, blob, meta); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	gotBootstrap, gotBlob, gotMeta, ok, err := cache.Lookup(key)
+	if err != nil {
+		t.Fatalf("Lookup after Store: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Lookup after Store: got miss, want hit")
+	}
+	if gotMeta != meta {
+		t.Fatalf("Lookup meta = %+v, want %+v", gotMeta, meta)
+	}
+	if data, err := ioutil.ReadFile(gotBootstrap); err != nil || string(data) != "bootstrap-content" {
+		t.Fatalf("cached bootstrap content = %q, %v", data, err)
+	}
+	if data, err := ioutil.ReadFile(gotBlob); err != nil || string(data) != "blob-content" {
+		t.Fatalf("cached blob content = %q, %v", data, err)
+	}
+}
+
+// TestBlobCacheKeyDiffersByParentIdentity confirms that two builds of the
+// exact same layer content chained onto different parents never collide in
+// the cache: nydus-image's bootstrap output depends on the parent bootstrap,
+// not just the layer's own content.
+func TestBlobCacheKeyDiffersByParentIdentity(t *testing.T) {
+	cache := &BlobCache{}
+
+	noParent := cache.key("layer-digest", "chunk-dict", "v1", "", "", "", false)
+	parentA := cache.key("layer-digest", "chunk-dict", "v1", "", "", "parent-a", false)
+	parentB := cache.key("layer-digest", "chunk-dict", "v1", "", "", "parent-b", false)
+
+	if noParent == parentA || noParent == parentB || parentA == parentB {
+		t.Fatalf("cache keys collided across distinct parents: noParent=%s parentA=%s parentB=%s", noParent, parentA, parentB)
+	}
+}
+
+// TestPruneReclaimsOldestEntriesFirst exercises the blob cache GC entry
+// point: it should evict least-recently-modified entries first and stop as
+// soon as the directory is back at or under maxSize.
+func TestPruneReclaimsOldestEntriesFirst(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+
+	makeEntry := func(key string, size int) int64 {
+		src := filepath.Join(dir, key+".src")
+		if err := ioutil.WriteFile(src, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Store(key, src, "", blobCacheMeta{}); err != nil {
+			t.Fatalf("Store %s: %v", key, err)
+		}
+		entrySize, err := dirSize(cache.entryDir(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entrySize
+	}
+
+	oldestSize := makeEntry("oldest", 100)
+	time.Sleep(10 * time.Millisecond)
+	newestSize := makeEntry("newest", 100)
+
+	reclaimed, err := Prune(dir, newestSize)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if reclaimed != oldestSize {
+		t.Fatalf("reclaimed = %d, want %d (the oldest entry's size)", reclaimed, oldestSize)
+	}
+
+	if _, err := os.Stat(cache.entryDir("oldest")); !os.IsNotExist(err) {
+		t.Fatalf("oldest entry should have been pruned, stat err = %v", err)
+	}
+	if _, err := os.Stat(cache.entryDir("newest")); err != nil {
+		t.Fatalf("newest entry should have survived: %v", err)
+	}
+}
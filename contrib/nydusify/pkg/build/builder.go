@@ -0,0 +1,123 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// BuilderOption holds everything a single `nydus-image create` invocation
+// needs to turn one layer's rootfs diff into a bootstrap and blob.
+type BuilderOption struct {
+	ParentBootstrapPath string
+	BootstrapPath       string
+	RootfsPath          string
+	PrefetchPatterns    string
+	WhiteoutSpec        string
+	OutputJSONPath      string
+	BlobPath            string
+	AlignedChunk        bool
+	ChunkDict           string
+	ImageVersion        string
+
+	// ChunkingMode selects fixed-size (ChunkingModeFixed, the default) or
+	// content-defined (ChunkingModeCDC) chunk boundaries.
+	ChunkingMode ChunkingMode
+	// ChunkPlanPath points at the chunk-plan file produced by planCDCChunks
+	// for ChunkingModeCDC builds; ignored otherwise.
+	ChunkPlanPath string
+}
+
+// MergeOption configures a `nydus-image merge` invocation that chains
+// independently-built, standalone per-layer bootstraps (each covering only
+// its own layer's diff, unaware of any parent) into one bootstrap
+// representing the full parent-chain view up to and including the last
+// source bootstrap. Unlike BuilderOption's `create`, this never touches
+// the original layer rootfs, so it's cheap relative to extraction.
+type MergeOption struct {
+	// SourceBootstrapPaths lists the standalone bootstraps to chain,
+	// oldest (the root of the chain) first.
+	SourceBootstrapPaths []string
+	TargetBootstrapPath  string
+	OutputJSONPath       string
+}
+
+// Builder wraps the `nydus-image` binary.
+type Builder struct {
+	binaryPath string
+}
+
+// NewBuilder creates a Builder that shells out to the nydus-image binary at
+// `binaryPath`.
+func NewBuilder(binaryPath string) *Builder {
+	return &Builder{binaryPath: binaryPath}
+}
+
+// Run invokes `nydus-image create` for a single layer.
+func (builder *Builder) Run(option BuilderOption) error {
+	args := []string{
+		"create",
+		"--bootstrap", option.BootstrapPath,
+		"--blob", option.BlobPath,
+		"--output-json", option.OutputJSONPath,
+	}
+
+	if option.ParentBootstrapPath != "" {
+		args = append(args, "--parent-bootstrap", option.ParentBootstrapPath)
+	}
+	if option.WhiteoutSpec != "" {
+		args = append(args, "--whiteout-spec", option.WhiteoutSpec)
+	}
+	if option.ChunkDict != "" {
+		args = append(args, "--chunk-dict", option.ChunkDict)
+	}
+	if option.PrefetchPatterns != "" {
+		args = append(args, "--prefetch-patterns", option.PrefetchPatterns)
+	}
+	if option.ImageVersion != "" {
+		args = append(args, "--fs-version", option.ImageVersion)
+	}
+	if option.AlignedChunk {
+		args = append(args, "--aligned-chunk")
+	}
+	if option.ChunkingMode == ChunkingModeCDC && option.ChunkPlanPath != "" {
+		args = append(args, "--chunk-plan", option.ChunkPlanPath)
+	}
+
+	args = append(args, option.RootfsPath)
+
+	cmd := exec.Command(builder.binaryPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "run nydus-image create")
+	}
+
+	return nil
+}
+
+// Merge invokes `nydus-image merge` to chain standalone per-layer
+// bootstraps into one, without re-extracting or re-chunking any layer.
+func (builder *Builder) Merge(option MergeOption) error {
+	args := []string{"merge", "--bootstrap", option.TargetBootstrapPath}
+	if option.OutputJSONPath != "" {
+		args = append(args, "--output-json", option.OutputJSONPath)
+	}
+	args = append(args, option.SourceBootstrapPaths...)
+
+	cmd := exec.Command(builder.binaryPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "run nydus-image merge")
+	}
+
+	return nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ChunkingMode selects how Workflow splits regular file content into
+// dedup-able chunks before handing a layer to nydus-image.
+type ChunkingMode string
+
+const (
+	// ChunkingModeFixed is today's behavior: nydus-image picks chunk
+	// boundaries itself, optionally aligned via BuilderOption.AlignedChunk.
+	// This is the default when WorkflowOption.ChunkingMode is unset.
+	ChunkingModeFixed ChunkingMode = "fixed"
+
+	// ChunkingModeCDC content-defines chunk boundaries with a FastCDC-style
+	// rolling gear hash before the build. Unlike fixed-size chunking, a
+	// small edit to a large mutable file (a database, model weights) only
+	// perturbs the chunks around the edit, so most of the file still dedups
+	// against a prior version.
+	ChunkingModeCDC ChunkingMode = "cdc"
+)
+
+const (
+	cdcMinChunkSize = 2 * 1024
+	cdcAvgChunkSize = 16 * 1024
+	cdcMaxChunkSize = 64 * 1024
+
+	// cdcDefaultMaskBits is chosen so that, for uniformly random gear hash
+	// output, a boundary is expected every 2^cdcDefaultMaskBits bytes,
+	// i.e. cdcAvgChunkSize.
+	cdcDefaultMaskBits = 14
+)
+
+// gearTable is the rolling hash's per-byte-value table, filled in init()
+// with deterministic pseudo-random 64-bit values (FastCDC calls this the
+// "gear" table).
+var gearTable [256]uint64
+
+func init() {
+	seed := uint64(0x9E3779B97F4A7C15)
+	for i := range gearTable {
+		seed = splitmix64(seed)
+		gearTable[i] = seed
+	}
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	z := x
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// ChunkBoundary is one content-defined chunk within a file, as a byte range.
+type ChunkBoundary struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Digest string `json:"digest"`
+}
+
+// FileChunkPlan is the set of chunk boundaries computed for a single
+// regular file in a layer, keyed by its path relative to the layer root.
+type FileChunkPlan struct {
+	Path   string          `json:"path"`
+	Chunks []ChunkBoundary `json:"chunks"`
+}
+
+// ChunkPlan is what gets written to the `--chunk-plan` file nydus-image
+// reads in ChunkingModeCDC, so it reuses our boundaries instead of picking
+// its own.
+type ChunkPlan struct {
+	Files []FileChunkPlan `json:"files"`
+}
+
+// DedupReport summarizes, for one layer's CDC pre-scan, how many chunk
+// bytes were already known (to this Workflow, across its ChunkDict and
+// prior layers) versus newly unique. It's written alongside the existing
+// `-output.json` as `-dedup-report.json` to help tune chunking parameters.
+type DedupReport struct {
+	UniqueChunks  int   `json:"uniqueChunks"`
+	UniqueBytes   int64 `json:"uniqueBytes"`
+	DedupedChunks int   `json:"dedupedChunks"`
+	DedupedBytes  int64 `json:"dedupedBytes"`
+}
+
+// chunkPlanPath and dedupReportPath follow the same `<bootstrap>-suffix`
+// convention as buildJob.outputJSONPath.
+func (job *buildJob) chunkPlanPath() string {
+	return job.bootstrapPath + "-chunk-plan.json"
+}
+
+func (job *buildJob) dedupReportPath() string {
+	return job.bootstrapPath + "-dedup-report.json"
+}
+
+// chunkDictIndex tracks the set of chunk digests known to the active
+// ChunkDict, persisted as a `<ChunkDict>.chunk-index.json` sidecar file so
+// DedupReport reflects dedup against the dict itself — across processes and
+// Workflow instances, since the dict is normally a prior, already-built
+// artifact rather than something only this process has seen.
+type chunkDictIndex struct {
+	mu      sync.Mutex
+	path    string
+	digests map[string]struct{}
+}
+
+func chunkDictIndexPath(chunkDict string) string {
+	return chunkDict + ".chunk-index.json"
+}
+
+// loadChunkDictIndex opens the sidecar index for `chunkDict`, or returns an
+// empty, process-local index (never persisted) when chunkDict is unset.
+func loadChunkDictIndex(chunkDict string) (*chunkDictIndex, error) {
+	idx := &chunkDictIndex{digests: make(map[string]struct{})}
+	if chunkDict == "" {
+		return idx, nil
+	}
+	idx.path = chunkDictIndexPath(chunkDict)
+
+	data, err := ioutil.ReadFile(idx.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, errors.Wrap(err, "read chunk dict index")
+	}
+
+	var digests []string
+	if err := json.Unmarshal(data, &digests); err != nil {
+		return nil, errors.Wrap(err, "parse chunk dict index")
+	}
+	for _, d := range digests {
+		idx.digests[d] = struct{}{}
+	}
+
+	return idx, nil
+}
+
+// seenOrRecord reports whether `digest` was already known to the index —
+// from the dict itself or a prior layer processed through it — and records
+// it for next time if not.
+func (idx *chunkDictIndex) seenOrRecord(digest string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.digests[digest]; ok {
+		return true
+	}
+	idx.digests[digest] = struct{}{}
+	return false
+}
+
+// save persists the index to its sidecar file, atomically. A no-op when
+// there's no ChunkDict to colocate it with.
+//
+// It holds `idx.mu` for the whole snapshot-marshal-write-rename sequence,
+// not just the snapshot: WorkflowScheduler calls this once per layer from
+// several goroutines at once, and if the snapshot were taken outside the
+// lock, two concurrent saves could race to rename — the one that
+// snapshotted fewer digests finishing last and clobbering the file with a
+// smaller set. Serializing the whole thing guarantees each completed write
+// reflects a superset of every previously completed one.
+func (idx *chunkDictIndex) save() error {
+	if idx.path == "" {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	digests := make([]string, 0, len(idx.digests))
+	for d := range idx.digests {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return errors.Wrap(err, "marshal chunk dict index")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(idx.path), filepath.Base(idx.path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "create chunk dict index temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write chunk dict index temp file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "fsync chunk dict index temp file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close chunk dict index temp file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), idx.path), "rename chunk dict index into place")
+}
+
+// planCDCChunks walks the regular files under `layerDir`, computes
+// FastCDC-style chunk boundaries for each by streaming its content (so a
+// large mutable file like a database or model weights is never fully
+// buffered in memory), and records how many of the resulting chunk bytes
+// are already known to the active ChunkDict.
+func (workflow *Workflow) planCDCChunks(layerDir string) (*ChunkPlan, DedupReport, error) {
+	var plan ChunkPlan
+	var report DedupReport
+
+	err := filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(layerDir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", path)
+		}
+		chunks, err := cdcChunkFile(f)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "chunk %s", path)
+		}
+
+		for _, c := range chunks {
+			if workflow.cdcIndex.seenOrRecord(c.Digest) {
+				report.DedupedChunks++
+				report.DedupedBytes += c.Length
+			} else {
+				report.UniqueChunks++
+				report.UniqueBytes += c.Length
+			}
+		}
+
+		plan.Files = append(plan.Files, FileChunkPlan{Path: relPath, Chunks: chunks})
+		return nil
+	})
+	if err != nil {
+		return nil, DedupReport{}, err
+	}
+
+	if err := workflow.cdcIndex.save(); err != nil {
+		return nil, DedupReport{}, errors.Wrap(err, "save chunk dict index")
+	}
+
+	return &plan, report, nil
+}
+
+// cdcChunkFile splits `r` into content-defined chunks using a FastCDC-style
+// gear-hash rule with a single mask: a boundary is cut once the rolling gear hash's
+// low cdcDefaultMaskBits bits are zero, subject to the min/max chunk size
+// bounds. It streams `r` one byte at a time rather than reading it fully
+// into memory first, so chunking a multi-gigabyte file costs no more than
+// cdcMaxChunkSize bytes of buffering.
+func cdcChunkFile(r io.Reader) ([]ChunkBoundary, error) {
+	const mask = uint64(1)<<cdcDefaultMaskBits - 1
+
+	br := bufio.NewReader(r)
+	var chunks []ChunkBoundary
+	buf := make([]byte, 0, cdcMaxChunkSize)
+	var hash uint64
+	var offset int64
+
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		chunks = append(chunks, newChunkBoundary(buf, offset))
+		offset += int64(len(buf))
+		buf = make([]byte, 0, cdcMaxChunkSize)
+		hash = 0
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, b)
+		hash = (hash << 1) + gearTable[b]
+
+		if len(buf) >= cdcMaxChunkSize || (len(buf) >= cdcMinChunkSize && hash&mask == 0) {
+			flush()
+		}
+	}
+	flush()
+
+	return chunks, nil
+}
+
+func newChunkBoundary(data []byte, offset int64) ChunkBoundary {
+	sum := sha256.Sum256(data)
+	return ChunkBoundary{
+		Offset: offset,
+		Length: int64(len(data)),
+		Digest: "sha256:" + hex.EncodeToString(sum[:]),
+	}
+}
+
+// writeChunkPlan marshals `plan` to `path`.
+func writeChunkPlan(plan *ChunkPlan, path string) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return errors.Wrap(err, "marshal chunk plan")
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeDedupReport marshals `report` to `path`.
+func writeDedupReport(report DedupReport, path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal dedup report")
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestCdcChunkFileDeterministic checks that chunking the same content twice
+// produces identical boundaries, and that prepending a few bytes only
+// perturbs the chunks near the edit rather than every chunk after it —
+// the property content-defined chunking is supposed to give over fixed-size
+// chunking.
+func TestCdcChunkFileDeterministic(t *testing.T) {
+	data := make([]byte, 5*cdcMaxChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	first, err := cdcChunkFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cdcChunkFile: %v", err)
+	}
+	second, err := cdcChunkFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cdcChunkFile: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("chunking the same content twice produced different boundaries")
+	}
+
+	edited := append([]byte("edit-near-the-front"), data...)
+	chunks, err := cdcChunkFile(bytes.NewReader(edited))
+	if err != nil {
+		t.Fatalf("cdcChunkFile: %v", err)
+	}
+
+	origDigests := make(map[string]bool, len(first))
+	for _, c := range first {
+		origDigests[c.Digest] = true
+	}
+	reused := 0
+	for _, c := range chunks {
+		if origDigests[c.Digest] {
+			reused++
+		}
+	}
+	if reused == 0 {
+		t.Fatalf("editing the front reused none of %d original chunks, want most of the tail to still dedup", len(first))
+	}
+}
+
+func TestCdcChunkFileRespectsSizeBounds(t *testing.T) {
+	data := make([]byte, 10*cdcMaxChunkSize)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	chunks, err := cdcChunkFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cdcChunkFile: %v", err)
+	}
+
+	var total int64
+	for i, c := range chunks {
+		if c.Length > cdcMaxChunkSize {
+			t.Fatalf("chunk %d length %d exceeds cdcMaxChunkSize %d", i, c.Length, cdcMaxChunkSize)
+		}
+		if i != len(chunks)-1 && c.Length < cdcMinChunkSize {
+			t.Fatalf("non-final chunk %d length %d is below cdcMinChunkSize %d", i, c.Length, cdcMinChunkSize)
+		}
+		if c.Offset != total {
+			t.Fatalf("chunk %d offset = %d, want %d", i, c.Offset, total)
+		}
+		total += c.Length
+	}
+	if total != int64(len(data)) {
+		t.Fatalf("chunk lengths sum to %d, want %d", total, len(data))
+	}
+}
+
+// TestChunkDictIndexConcurrentSaveKeepsAllDigests exercises the scenario
+// WorkflowScheduler actually drives: many goroutines sharing one
+// chunkDictIndex, each recording its own digest and then persisting. If
+// save() ever let one goroutine's rename clobber another's with a smaller
+// snapshot, this would flake with a reloaded index missing digests.
+func TestChunkDictIndexConcurrentSaveKeepsAllDigests(t *testing.T) {
+	dir := t.TempDir()
+	chunkDict := filepath.Join(dir, "dict")
+
+	idx, err := loadChunkDictIndex(chunkDict)
+	if err != nil {
+		t.Fatalf("loadChunkDictIndex: %v", err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			idx.seenOrRecord(fmt.Sprintf("sha256:%d", i))
+			if err := idx.save(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("save: %v", err)
+	}
+
+	reloaded, err := loadChunkDictIndex(chunkDict)
+	if err != nil {
+		t.Fatalf("loadChunkDictIndex after concurrent saves: %v", err)
+	}
+	if len(reloaded.digests) != n {
+		t.Fatalf("reloaded index has %d digests, want %d: a concurrent save clobbered another's", len(reloaded.digests), n)
+	}
+}
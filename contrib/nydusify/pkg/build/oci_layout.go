@@ -0,0 +1,274 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ociLayoutVersion = "1.0.0"
+
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifestV2   = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeConfigV1     = "application/vnd.docker.container.image.v1+json"
+	mediaTypeNydusLayer   = "application/vnd.oci.image.layer.nydus.blob.v1+tar"
+	digestAlgorithmSHA256 = "sha256"
+)
+
+// ociDescriptor mirrors the OCI/Docker content descriptor: a media type,
+// digest and size identifying a blob.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociIndex is the top-level `index.json` of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is a Docker Manifest V2 Schema 2 manifest.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociConfig is the nydus-specific image config referenced by the manifest.
+// It doesn't carry the usual OCI runtime config fields because the result
+// is never run directly; it only records what a puller needs to make sense
+// of the RAFS bootstrap and blobs.
+type ociConfig struct {
+	RAFSVersion      string `json:"rafsVersion"`
+	ChunkDictDigest  string `json:"chunkDictDigest,omitempty"`
+	PrefetchPatterns string `json:"prefetchPatterns,omitempty"`
+}
+
+// ociLayoutDir is where EmitOCILayout assembles the image layout, rooted
+// under the workflow's TargetDir.
+func (workflow *Workflow) ociLayoutDir() string {
+	return filepath.Join(workflow.TargetDir, "oci")
+}
+
+// EmitOCILayout assembles an OCI image layout (`oci-layout`, `index.json`,
+// `blobs/sha256/...`) describing a Docker Manifest V2 Schema 2 image whose
+// layers are the nydus blobs in `blobPaths`, in order, so that e.g.
+// `skopeo copy oci:./out docker://...` can push the result directly. It's a
+// no-op unless WorkflowOption.ManifestOutput is set.
+func (workflow *Workflow) EmitOCILayout(blobPaths []string) error {
+	if !workflow.ManifestOutput {
+		return nil
+	}
+
+	layoutDir := workflow.ociLayoutDir()
+	blobsDir := filepath.Join(layoutDir, "blobs", digestAlgorithmSHA256)
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return errors.Wrap(err, "create oci layout blobs directory")
+	}
+
+	var layers []ociDescriptor
+	for _, blobPath := range blobPaths {
+		if blobPath == "" {
+			continue
+		}
+		desc, err := copyBlobIntoLayout(blobPath, blobsDir, mediaTypeNydusLayer)
+		if err != nil {
+			return errors.Wrapf(err, "add layer %s to oci layout", blobPath)
+		}
+		layers = append(layers, desc)
+	}
+
+	chunkDictDigest, err := digestFile(workflow.ChunkDict)
+	if err != nil {
+		return errors.Wrap(err, "digest chunk dict")
+	}
+
+	configBytes, err := json.Marshal(ociConfig{
+		RAFSVersion:      workflow.ImageVersion,
+		ChunkDictDigest:  chunkDictDigest,
+		PrefetchPatterns: workflow.PrefetchPatterns,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci config")
+	}
+	configDesc, err := writeBlobIntoLayout(configBytes, blobsDir, mediaTypeConfigV1)
+	if err != nil {
+		return errors.Wrap(err, "write oci config blob")
+	}
+
+	manifestBytes, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifestV2,
+		Config:        configDesc,
+		Layers:        layers,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci manifest")
+	}
+	manifestDesc, err := writeBlobIntoLayout(manifestBytes, blobsDir, mediaTypeManifestV2)
+	if err != nil {
+		return errors.Wrap(err, "write oci manifest blob")
+	}
+
+	indexBytes, err := json.MarshalIndent(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIIndex,
+		Manifests:     []ociDescriptor{manifestDesc},
+	}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal oci index")
+	}
+	if err := ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), indexBytes, 0644); err != nil {
+		return errors.Wrap(err, "write index.json")
+	}
+
+	marker := []byte(`{"imageLayoutVersion":"` + ociLayoutVersion + `"}`)
+	if err := ioutil.WriteFile(filepath.Join(layoutDir, "oci-layout"), marker, 0644); err != nil {
+		return errors.Wrap(err, "write oci-layout marker")
+	}
+
+	return ValidateOCILayout(layoutDir)
+}
+
+// copyBlobIntoLayout copies `src` into `blobsDir`, named by the sha256
+// digest of its actual content (not whatever name it already had), and
+// returns the descriptor to reference it with.
+func copyBlobIntoLayout(src, blobsDir, mediaType string) (ociDescriptor, error) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return writeBlobIntoLayout(data, blobsDir, mediaType)
+}
+
+// writeBlobIntoLayout writes `data` into `blobsDir`, named by its sha256
+// digest, and returns the descriptor to reference it with.
+func writeBlobIntoLayout(data []byte, blobsDir, mediaType string) (ociDescriptor, error) {
+	sum := sha256.Sum256(data)
+	digest := digestAlgorithmSHA256 + ":" + hex.EncodeToString(sum[:])
+
+	if err := ioutil.WriteFile(filepath.Join(blobsDir, hex.EncodeToString(sum[:])), data, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      int64(len(data)),
+	}, nil
+}
+
+// digestFile returns the sha256 digest of the file at `path`, or "" if
+// `path` is empty.
+func digestFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return digestAlgorithmSHA256 + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// ValidateOCILayout walks the OCI image layout rooted at `dir` and rejects
+// it if any referenced blob's actual content doesn't match its descriptor's
+// digest and size, which would otherwise surface as a confusing failure
+// much later, inside `skopeo copy` or the registry push.
+func ValidateOCILayout(dir string) error {
+	markerBytes, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		return errors.Wrap(err, "read oci-layout marker")
+	}
+	var marker struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(markerBytes, &marker); err != nil {
+		return errors.Wrap(err, "parse oci-layout marker")
+	}
+	if marker.ImageLayoutVersion != ociLayoutVersion {
+		return errors.Errorf("unsupported oci layout version %q", marker.ImageLayoutVersion)
+	}
+
+	indexBytes, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return errors.Wrap(err, "read index.json")
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return errors.Wrap(err, "parse index.json")
+	}
+
+	for _, manifestDesc := range index.Manifests {
+		manifestBytes, err := verifyLayoutBlob(dir, manifestDesc)
+		if err != nil {
+			return err
+		}
+
+		var manifest ociManifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return errors.Wrapf(err, "parse manifest %s", manifestDesc.Digest)
+		}
+
+		if _, err := verifyLayoutBlob(dir, manifest.Config); err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			if _, err := verifyLayoutBlob(dir, layer); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyLayoutBlob reads the blob referenced by `desc` from the layout
+// rooted at `dir` and confirms its content actually hashes to desc.Digest
+// and matches desc.Size.
+func verifyLayoutBlob(dir string, desc ociDescriptor) ([]byte, error) {
+	algo, hexDigest, ok := splitDigest(desc.Digest)
+	if !ok {
+		return nil, errors.Errorf("malformed digest %q", desc.Digest)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "blobs", algo, hexDigest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read blob %s", desc.Digest)
+	}
+
+	if int64(len(data)) != desc.Size {
+		return nil, errors.Errorf("blob %s: descriptor size %d doesn't match actual size %d", desc.Digest, desc.Size, len(data))
+	}
+
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != hexDigest {
+		return nil, errors.Errorf("blob %s: content actually hashes to %s:%s", desc.Digest, algo, actual)
+	}
+
+	return data, nil
+}
+
+func splitDigest(digest string) (algo, hex string, ok bool) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
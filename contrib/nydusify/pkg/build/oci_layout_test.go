@@ -0,0 +1,78 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmitOCILayoutThenValidate(t *testing.T) {
+	dir := t.TempDir()
+
+	blobPath := filepath.Join(dir, "blob")
+	if err := ioutil.WriteFile(blobPath, []byte("nydus-blob-content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := &Workflow{WorkflowOption: WorkflowOption{TargetDir: dir, ManifestOutput: true}}
+	if err := workflow.EmitOCILayout([]string{blobPath}); err != nil {
+		t.Fatalf("EmitOCILayout: %v", err)
+	}
+
+	if err := ValidateOCILayout(workflow.ociLayoutDir()); err != nil {
+		t.Fatalf("ValidateOCILayout on an untouched layout: %v", err)
+	}
+}
+
+// TestValidateOCILayoutRejectsTamperedBlob confirms that if a blob under the
+// layout is modified after EmitOCILayout wrote it, ValidateOCILayout catches
+// the mismatch instead of letting it surface later as a confusing failure
+// inside skopeo copy or the registry push.
+func TestValidateOCILayoutRejectsTamperedBlob(t *testing.T) {
+	dir := t.TempDir()
+
+	blobPath := filepath.Join(dir, "blob")
+	if err := ioutil.WriteFile(blobPath, []byte("nydus-blob-content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := &Workflow{WorkflowOption: WorkflowOption{TargetDir: dir, ManifestOutput: true}}
+	if err := workflow.EmitOCILayout([]string{blobPath}); err != nil {
+		t.Fatalf("EmitOCILayout: %v", err)
+	}
+
+	layoutDir := workflow.ociLayoutDir()
+	layerBlobsDir := filepath.Join(layoutDir, "blobs", digestAlgorithmSHA256)
+	entries, err := ioutil.ReadDir(layerBlobsDir)
+	if err != nil {
+		t.Fatalf("read layout blobs dir: %v", err)
+	}
+
+	tampered := false
+	for _, entry := range entries {
+		blob := filepath.Join(layerBlobsDir, entry.Name())
+		data, err := ioutil.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "nydus-blob-content" {
+			continue
+		}
+		if err := ioutil.WriteFile(blob, []byte("corrupted-content!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tampered = true
+		break
+	}
+	if !tampered {
+		t.Fatalf("didn't find the layer blob to tamper with among %d layout blobs", len(entries))
+	}
+
+	if err := ValidateOCILayout(layoutDir); err == nil {
+		t.Fatalf("ValidateOCILayout accepted a tampered blob")
+	}
+}
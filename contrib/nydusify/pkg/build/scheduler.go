@@ -0,0 +1,172 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// LayerDescriptor describes a single layer to be built by WorkflowScheduler.
+// Descriptors must be supplied in parent-chain order: the descriptor at
+// index i is the parent of the descriptor at index i+1.
+type LayerDescriptor struct {
+	LayerDir      string
+	WhiteoutSpec  string
+	BootstrapPath string
+	AlignedChunk  bool
+
+	// LayerDigest is the upstream OCI layer diffID/tar digest. It's only
+	// used to key the blob cache (see WorkflowOption.BlobCacheDir); leave
+	// it empty to always build.
+	LayerDigest string
+}
+
+// ProgressCallback is invoked once per layer as soon as its extraction phase
+// completes, so callers can render a progress bar without waiting for the
+// whole pipeline to finish. `index` is the layer's position in the slice
+// passed to WorkflowScheduler.Build, `total` is the number of layers.
+type ProgressCallback func(index, total int)
+
+// WorkflowScheduler pipelines Workflow builds across many layers: the
+// expensive diff extraction, chunking and blob hashing for each layer runs
+// concurrently across a bounded worker pool, each producing a standalone
+// bootstrap that doesn't know about any parent. The commit phase then
+// chains those standalone bootstraps into the real parent order with
+// `nydus-image merge`, which never re-reads the layer rootfs, so it's cheap
+// relative to extraction — similar in spirit to moby's `distribution/xfer`
+// transfer manager, where the expensive transfer runs concurrently and only
+// bookkeeping is serialized.
+type WorkflowScheduler struct {
+	workflow    *Workflow
+	concurrency int
+	onProgress  ProgressCallback
+}
+
+// NewWorkflowScheduler creates a scheduler bound to `workflow`. The worker
+// pool size is taken from `workflow.Concurrency` and defaults to 4 when
+// unset or non-positive. `onProgress` may be nil.
+func NewWorkflowScheduler(workflow *Workflow, onProgress ProgressCallback) *WorkflowScheduler {
+	concurrency := workflow.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return &WorkflowScheduler{
+		workflow:    workflow,
+		concurrency: concurrency,
+		onProgress:  onProgress,
+	}
+}
+
+// extractedLayer is the result of the parallel extraction phase for one
+// layer: its own standalone bootstrap (unaware of any parent), the blob it
+// produced (if any), and the builder version that built it.
+type extractedLayer struct {
+	descriptor          LayerDescriptor
+	standaloneBootstrap string
+	blobPath            string
+	builderVersion      string
+}
+
+// standaloneBootstrapPath is where the extraction phase writes a layer's
+// unchained bootstrap, kept separate from LayerDescriptor.BootstrapPath
+// (the final, chained path the commit phase writes via merge) so the two
+// never collide and the blob cache never confuses one for the other.
+func standaloneBootstrapPath(finalBootstrapPath string) string {
+	return finalBootstrapPath + ".standalone"
+}
+
+// Build extracts and commits `layers` and returns the final blob path of
+// each, indexed the same way as `layers` (empty string for layers that
+// produced no new blob). Cancelling `ctx` keeps queued layers from starting
+// extraction and is also checked between every layer of the commit phase; a
+// layer whose extraction has already started runs to completion.
+func (s *WorkflowScheduler) Build(ctx context.Context, layers []LayerDescriptor) ([]string, error) {
+	extracted := make([]extractedLayer, len(layers))
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, s.concurrency)
+
+	for i, layer := range layers {
+		i, layer := i, layer
+		eg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-egCtx.Done():
+				return egCtx.Err()
+			}
+			defer func() { <-sem }()
+
+			// Extraction doesn't need the real parent bootstrap: the
+			// layer's own diff content, chunking and blob digest are
+			// independent of where it eventually lands in the chain. Its
+			// result is a standalone bootstrap, not the final one, so the
+			// cheap commit phase below has something to chain together
+			// instead of redoing this expensive work itself.
+			job := &buildJob{bootstrapPath: standaloneBootstrapPath(layer.BootstrapPath)}
+			blobPath, err := s.workflow.buildLayer(egCtx, job, layer.LayerDir, layer.WhiteoutSpec, layer.LayerDigest, layer.AlignedChunk)
+			if err != nil {
+				return errors.Wrapf(err, "extract layer %d", i)
+			}
+			extracted[i] = extractedLayer{
+				descriptor:          layer,
+				standaloneBootstrap: job.bootstrapPath,
+				blobPath:            blobPath,
+				builderVersion:      job.builderVersion,
+			}
+
+			if s.onProgress != nil {
+				s.onProgress(i, len(layers))
+			}
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Extraction is done, so nothing touches workflow.BuilderVersion
+	// concurrently anymore: safe to record it here, from the last layer in
+	// the chain, the same way the legacy serial Build does after its one
+	// buildLayer call.
+	if len(extracted) > 0 {
+		if last := extracted[len(extracted)-1].builderVersion; last != "" {
+			s.workflow.BuilderVersion = last
+		}
+	}
+
+	// Commit phase: chain the standalone bootstraps produced above into the
+	// real parent order, strictly in sequence. `nydus-image merge` only
+	// combines bootstrap metadata that's already on disk — it never
+	// re-reads a layer's rootfs or re-chunks its blob — so this is cheap
+	// relative to extraction, unlike re-running the full builder.
+	blobPaths := make([]string, len(layers))
+	sourceBootstraps := make([]string, 0, len(layers))
+	for i, e := range extracted {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		sourceBootstraps = append(sourceBootstraps, e.standaloneBootstrap)
+
+		if err := s.workflow.builder.Merge(MergeOption{
+			SourceBootstrapPaths: sourceBootstraps,
+			TargetBootstrapPath:  e.descriptor.BootstrapPath,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "merge layer %d into parent chain", i)
+		}
+
+		blobPaths[i] = e.blobPath
+	}
+
+	if err := s.workflow.EmitOCILayout(blobPaths); err != nil {
+		return nil, errors.Wrap(err, "emit oci layout")
+	}
+
+	return blobPaths, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFakeNydusImage installs a shell stand-in for the nydus-image binary
+// that's just enough to exercise WorkflowScheduler without a real RAFS
+// builder: `create` records which rootfs it was asked to build into the
+// bootstrap file, and `merge` concatenates its source bootstraps into the
+// target in the order given, so a test can read the final bootstrap back to
+// check merge order.
+func writeFakeNydusImage(t *testing.T, dir string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "fake-nydus-image.sh")
+	script := `#!/bin/sh
+set -e
+cmd="$1"; shift
+case "$cmd" in
+  create)
+    bootstrap=""
+    blob=""
+    outjson=""
+    rootfs=""
+    while [ "$#" -gt 0 ]; do
+      case "$1" in
+        --bootstrap) bootstrap="$2"; shift 2 ;;
+        --blob) blob="$2"; shift 2 ;;
+        --output-json) outjson="$2"; shift 2 ;;
+        --parent-bootstrap|--whiteout-spec|--chunk-dict|--prefetch-patterns|--fs-version) shift 2 ;;
+        --aligned-chunk) shift ;;
+        *) rootfs="$1"; shift ;;
+      esac
+    done
+    echo "bootstrap:$rootfs" > "$bootstrap"
+    echo "blob:$rootfs" > "$blob"
+    blobid=$(printf '%s' "$rootfs" | sha256sum | cut -d' ' -f1)
+    printf '{"Version":"fake","Blobs":["%s"]}' "$blobid" > "$outjson"
+    ;;
+  merge)
+    target=""
+    sources=""
+    while [ "$#" -gt 0 ]; do
+      case "$1" in
+        --bootstrap) target="$2"; shift 2 ;;
+        --output-json) shift 2 ;;
+        *) sources="$sources $1"; shift ;;
+      esac
+    done
+    : > "$target"
+    for src in $sources; do
+      cat "$src" >> "$target"
+    done
+    ;;
+esac
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("write fake nydus-image: %v", err)
+	}
+	return path
+}
+
+// TestWorkflowSchedulerCommitsInParentChainOrder builds three layers through
+// WorkflowScheduler and checks that the commit phase chains their standalone
+// bootstraps in the same parent-chain order they were submitted, even though
+// extraction ran them concurrently.
+func TestWorkflowSchedulerCommitsInParentChainOrder(t *testing.T) {
+	dir := t.TempDir()
+	nydusImage := writeFakeNydusImage(t, dir)
+
+	targetDir := filepath.Join(dir, "work")
+	workflow, err := NewWorkflow(WorkflowOption{
+		TargetDir:      targetDir,
+		NydusImagePath: nydusImage,
+	})
+	if err != nil {
+		t.Fatalf("NewWorkflow: %v", err)
+	}
+
+	var layers []LayerDescriptor
+	for _, name := range []string{"base", "mid", "top"} {
+		layerDir := filepath.Join(dir, name)
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			t.Fatalf("mkdir %s: %v", name, err)
+		}
+		layers = append(layers, LayerDescriptor{
+			LayerDir:      layerDir,
+			BootstrapPath: filepath.Join(targetDir, name+"-bootstrap"),
+		})
+	}
+
+	scheduler := NewWorkflowScheduler(workflow, nil)
+	if _, err := scheduler.Build(context.Background(), layers); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	var want string
+	for _, l := range layers {
+		want += fmt.Sprintf("bootstrap:%s\n", l.LayerDir)
+	}
+
+	final, err := ioutil.ReadFile(layers[len(layers)-1].BootstrapPath)
+	if err != nil {
+		t.Fatalf("read final bootstrap: %v", err)
+	}
+	if got := string(final); got != want {
+		t.Fatalf("merged bootstrap order = %q, want %q", got, want)
+	}
+}
@@ -5,15 +5,19 @@
 package build
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/blobmeta"
 )
 
 type WorkflowOption struct {
@@ -22,17 +26,55 @@ type WorkflowOption struct {
 	NydusImagePath   string
 	PrefetchPatterns string
 	ImageVersion     string
+
+	// Concurrency bounds the number of layers that WorkflowScheduler will
+	// build at once. Defaults to 4 when unset or non-positive.
+	Concurrency int
+
+	// BlobCacheDir, when set, enables the blob cache: repeat builds of the
+	// same layer content (identified by its OCI layer digest) skip the
+	// nydus-image invocation and restore the cached bootstrap fragment and
+	// blob instead. See BlobCache.
+	BlobCacheDir string
+
+	// ManifestOutput, when set, makes WorkflowScheduler.Build assemble an
+	// OCI image layout under TargetDir/oci once every layer is committed.
+	// See Workflow.EmitOCILayout.
+	ManifestOutput bool
+
+	// ChunkingMode selects fixed-size (the default, ChunkingModeFixed) or
+	// content-defined (ChunkingModeCDC) chunk boundaries. See ChunkingMode.
+	ChunkingMode ChunkingMode
 }
 
 type Workflow struct {
 	WorkflowOption
-	BuilderVersion      string
-	bootstrapPath       string
-	blobsDir            string
-	backendConfig       string
+	BuilderVersion string
+	blobsDir       string
+	backendConfig  string
+	builder        *Builder
+
+	// BlobMeta records, per blob digest, the repositories it has already
+	// been pushed to. Call BlobMeta.Record after a successful push and
+	// BlobMeta.MountCandidates before one, to attempt a cross-repository
+	// blob mount instead of a full upload.
+	BlobMeta *blobmeta.Service
+
+	// blobCache is nil unless WorkflowOption.BlobCacheDir is set.
+	blobCache *BlobCache
+
+	// cdcIndex tracks which CDC chunk digests are already known to the
+	// active ChunkDict (persisted alongside it), so DedupReport can tell a
+	// layer's newly unique chunks from ones already dedup-able against the
+	// dict or an earlier layer built with it.
+	cdcIndex *chunkDictIndex
+
+	// parentBootstrapPath tracks chain state for callers that drive the
+	// legacy, strictly serial Build API below, where each call implicitly
+	// continues from the previous one. Concurrent builds never touch this
+	// field: they carry their own state in a buildJob instead, see
+	// WorkflowScheduler.
 	parentBootstrapPath string
-	builder             *Builder
-	lastBlobID          string
 }
 
 type debugJSON struct {
@@ -40,16 +82,28 @@ type debugJSON struct {
 	Blobs   []string
 }
 
+// buildJob carries the state of a single layer build: the bootstrap paths
+// involved and the last blob ID observed in its output JSON. Unlike the
+// `Workflow` struct itself, a buildJob belongs to exactly one build and is
+// never shared, so it's safe to build many layers concurrently against the
+// same Workflow.
+type buildJob struct {
+	bootstrapPath       string
+	parentBootstrapPath string
+	lastBlobID          string
+	builderVersion      string
+}
+
 // Dump output json file of every layer to $workdir/bootstraps directory
 // for debug or perf analysis purpose
-func (workflow *Workflow) buildOutputJSONPath() string {
-	return workflow.bootstrapPath + "-output.json"
+func (job *buildJob) outputJSONPath() string {
+	return job.bootstrapPath + "-output.json"
 }
 
 // Get latest built blob from blobs directory
-func (workflow *Workflow) getLatestBlobPath() (string, error) {
+func (workflow *Workflow) getLatestBlobPath(job *buildJob) (string, error) {
 	var data debugJSON
-	jsonBytes, err := ioutil.ReadFile(workflow.buildOutputJSONPath())
+	jsonBytes, err := ioutil.ReadFile(job.outputJSONPath())
 	if err != nil {
 		return "", err
 	}
@@ -59,16 +113,21 @@ func (workflow *Workflow) getLatestBlobPath() (string, error) {
 	blobIDs := data.Blobs
 
 	// Record builder version of current build environment for easy
-	// debugging and troubleshooting afterwards.
-	workflow.BuilderVersion = data.Version
+	// debugging and troubleshooting afterwards. This only touches `job`,
+	// not `workflow`: getLatestBlobPath runs from buildLayer, which
+	// WorkflowScheduler drives concurrently across many goroutines sharing
+	// one Workflow, so workflow.BuilderVersion must only be set from a
+	// call site that isn't run concurrently (see Build and
+	// WorkflowScheduler.Build).
+	job.builderVersion = data.Version
 
 	if len(blobIDs) == 0 {
 		return "", nil
 	}
 
 	latestBlobID := blobIDs[len(blobIDs)-1]
-	if latestBlobID != workflow.lastBlobID {
-		workflow.lastBlobID = latestBlobID
+	if latestBlobID != job.lastBlobID {
+		job.lastBlobID = latestBlobID
 		blobPath := filepath.Join(workflow.blobsDir, latestBlobID)
 		return blobPath, nil
 	}
@@ -89,44 +148,171 @@ func NewWorkflow(option WorkflowOption) (*Workflow, error) {
 	backendConfig := fmt.Sprintf(`{"dir": "%s"}`, blobsDir)
 	builder := NewBuilder(option.NydusImagePath)
 
+	blobMeta, err := blobmeta.NewService(filepath.Join(option.TargetDir, "blobmeta"))
+	if err != nil {
+		return nil, errors.Wrap(err, "create blob metadata service")
+	}
+
+	var blobCache *BlobCache
+	if option.BlobCacheDir != "" {
+		blobCache, err = NewBlobCache(option.BlobCacheDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "create blob cache")
+		}
+	}
+
+	cdcIndex, err := loadChunkDictIndex(option.ChunkDict)
+	if err != nil {
+		return nil, errors.Wrap(err, "load chunk dict index")
+	}
+
 	return &Workflow{
 		WorkflowOption: option,
 		blobsDir:       blobsDir,
 		backendConfig:  backendConfig,
 		builder:        builder,
+		BlobMeta:       blobMeta,
+		blobCache:      blobCache,
+		cdcIndex:       cdcIndex,
 	}, nil
 }
 
-// Build nydus bootstrap and blob, returned blobPath's basename is sha256 hex string
+// Push ensures the blob at `blobPath` exists in `repo`, preferring a
+// cross-repository mount (via BlobMeta's record of repositories the blob is
+// already known to be in) over a full upload through `mounter`. See
+// blobmeta.Service.Push.
+func (workflow *Workflow) Push(ctx context.Context, mounter blobmeta.Mounter, repo, blobPath string) error {
+	digest, err := digestFile(blobPath)
+	if err != nil {
+		return errors.Wrap(err, "digest blob")
+	}
+	return workflow.BlobMeta.Push(ctx, mounter, repo, digest)
+}
+
+// CacheStats returns the blob cache hit/miss counters, or (0, 0) when the
+// blob cache is disabled.
+func (workflow *Workflow) CacheStats() (hits, misses int64) {
+	if workflow.blobCache == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&workflow.blobCache.CacheHits), atomic.LoadInt64(&workflow.blobCache.CacheMisses)
+}
+
+// Build nydus bootstrap and blob, returned blobPath's basename is sha256 hex string.
+//
+// `layerDigest` is the upstream OCI layer diffID/tar digest; when the blob
+// cache is enabled it's the key that lets repeat builds of the same layer
+// content skip nydus-image entirely. Pass "" to always build.
+//
+// This is the legacy serial entry point: each call implicitly chains off the
+// previous one through `workflow.parentBootstrapPath`. For building many
+// layers concurrently, use WorkflowScheduler instead.
 func (workflow *Workflow) Build(
-	layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath string, alignedChunk bool,
+	layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath, layerDigest string, alignedChunk bool,
 ) (string, error) {
-	workflow.bootstrapPath = bootstrapPath
-
+	job := &buildJob{
+		bootstrapPath:       bootstrapPath,
+		parentBootstrapPath: workflow.parentBootstrapPath,
+	}
 	if parentBootstrapPath != "" {
-		workflow.parentBootstrapPath = parentBootstrapPath
+		job.parentBootstrapPath = parentBootstrapPath
+	}
+
+	blobPath, err := workflow.buildLayer(context.Background(), job, layerDir, whiteoutSpec, layerDigest, alignedChunk)
+
+	workflow.parentBootstrapPath = job.bootstrapPath
+	if job.builderVersion != "" {
+		workflow.BuilderVersion = job.builderVersion
+	}
+
+	return blobPath, err
+}
+
+// buildLayer runs a single nydus-image invocation for one layer and returns
+// the resulting blob's digest path. It operates purely on `job` and the
+// arguments passed in, so concurrent callers (see WorkflowScheduler) can
+// drive many of these at once without sharing mutable state.
+func (workflow *Workflow) buildLayer(
+	ctx context.Context, job *buildJob, layerDir, whiteoutSpec, layerDigest string, alignedChunk bool,
+) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	var cacheKey string
+	if workflow.blobCache != nil && layerDigest != "" {
+		// The parent bootstrap's content is part of what nydus-image's
+		// output depends on, so it must be part of the cache key too: a
+		// standalone build (no parent, as WorkflowScheduler's extraction
+		// phase does) and a build chained onto some parent are never
+		// interchangeable, even for the exact same layer content.
+		parentIdentity, err := digestFile(job.parentBootstrapPath)
+		if err != nil {
+			return "", errors.Wrap(err, "digest parent bootstrap for cache key")
+		}
+
+		cacheKey = workflow.blobCache.key(
+			layerDigest, workflow.ChunkDict, workflow.ImageVersion, workflow.PrefetchPatterns, whiteoutSpec, parentIdentity, alignedChunk)
+
+		cachedBootstrap, cachedBlob, meta, ok, err := workflow.blobCache.Lookup(cacheKey)
+		if err != nil {
+			return "", errors.Wrap(err, "lookup blob cache")
+		}
+		if ok {
+			if err := linkOrCopy(cachedBootstrap, job.bootstrapPath); err != nil {
+				return "", errors.Wrap(err, "restore cached bootstrap")
+			}
+			job.builderVersion = meta.BuilderVersion
+
+			if meta.BlobDigest == "" {
+				return "", nil
+			}
+			digestedBlobPath := filepath.Join(workflow.blobsDir, meta.BlobDigest)
+			if _, err := os.Stat(digestedBlobPath); os.IsNotExist(err) {
+				if err := linkOrCopy(cachedBlob, digestedBlobPath); err != nil {
+					return "", errors.Wrap(err, "restore cached blob")
+				}
+			}
+			job.lastBlobID = meta.BlobDigest
+			return digestedBlobPath, nil
+		}
 	}
 
 	blobPath := filepath.Join(workflow.blobsDir, uuid.NewString())
 
+	var chunkPlanPath string
+	if workflow.ChunkingMode == ChunkingModeCDC {
+		plan, report, err := workflow.planCDCChunks(layerDir)
+		if err != nil {
+			return "", errors.Wrap(err, "plan content-defined chunks")
+		}
+		chunkPlanPath = job.chunkPlanPath()
+		if err := writeChunkPlan(plan, chunkPlanPath); err != nil {
+			return "", errors.Wrap(err, "write chunk plan")
+		}
+		if err := writeDedupReport(report, job.dedupReportPath()); err != nil {
+			return "", errors.Wrap(err, "write dedup report")
+		}
+	}
+
 	if err := workflow.builder.Run(BuilderOption{
-		ParentBootstrapPath: workflow.parentBootstrapPath,
-		BootstrapPath:       workflow.bootstrapPath,
+		ParentBootstrapPath: job.parentBootstrapPath,
+		BootstrapPath:       job.bootstrapPath,
 		RootfsPath:          layerDir,
 		PrefetchPatterns:    workflow.PrefetchPatterns,
 		WhiteoutSpec:        whiteoutSpec,
-		OutputJSONPath:      workflow.buildOutputJSONPath(),
+		OutputJSONPath:      job.outputJSONPath(),
 		BlobPath:            blobPath,
 		AlignedChunk:        alignedChunk,
 		ChunkDict:           workflow.ChunkDict,
 		ImageVersion:        workflow.ImageVersion,
+		ChunkingMode:        workflow.ChunkingMode,
+		ChunkPlanPath:       chunkPlanPath,
 	}); err != nil {
 		return "", errors.Wrapf(err, "build layer %s", layerDir)
 	}
 
-	workflow.parentBootstrapPath = workflow.bootstrapPath
-
-	digestedBlobPath, err := workflow.getLatestBlobPath()
+	digestedBlobPath, err := workflow.getLatestBlobPath(job)
 	if err != nil {
 		return "", errors.Wrap(err, "get latest blob")
 	}
@@ -137,11 +323,13 @@ func (workflow *Workflow) Build(
 	blobInfo, err := os.Stat(blobPath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			workflow.populateBlobCache(cacheKey, job, "")
 			return "", nil
 		}
 		return "", err
 	}
 	if blobInfo.Size() == 0 {
+		workflow.populateBlobCache(cacheKey, job, "")
 		return "", nil
 	}
 
@@ -158,9 +346,30 @@ func (workflow *Workflow) Build(
 			return "", err
 		} else if err == os.ErrExist {
 			logrus.Warnf("Same blob %s are generated", digestedBlobPath)
+			workflow.populateBlobCache(cacheKey, job, digestedBlobPath)
 			return "", nil
 		}
 	}
 
+	workflow.populateBlobCache(cacheKey, job, digestedBlobPath)
+
 	return digestedBlobPath, nil
 }
+
+// populateBlobCache stores the just-completed build's bootstrap fragment
+// (and blob, if any) in the blob cache under `cacheKey`. A failure here is
+// logged, not fatal: a missed cache write just costs a future cache miss.
+func (workflow *Workflow) populateBlobCache(cacheKey string, job *buildJob, digestedBlobPath string) {
+	if workflow.blobCache == nil || cacheKey == "" {
+		return
+	}
+
+	meta := blobCacheMeta{BuilderVersion: job.builderVersion}
+	if digestedBlobPath != "" {
+		meta.BlobDigest = filepath.Base(digestedBlobPath)
+	}
+
+	if err := workflow.blobCache.Store(cacheKey, job.bootstrapPath, digestedBlobPath, meta); err != nil {
+		logrus.Warnf("populate blob cache: %s", err)
+	}
+}